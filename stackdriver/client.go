@@ -0,0 +1,40 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stackdriver ships Prometheus samples to the Stackdriver
+// Monitoring API.
+package stackdriver
+
+import (
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// metricsPrefix is prepended to every Stackdriver metric type this module
+// writes, e.g. "custom.googleapis.com/prometheus_target_interval_length_seconds".
+const metricsPrefix = "custom.googleapis.com"
+
+// StorageClient defines an interface on which any client used to write to
+// Stackdriver must implement. It exists mainly so tests can substitute a
+// fake in place of the real Stackdriver Monitoring API client.
+type StorageClient interface {
+	// Store sends a batch of samples to the remote storage.
+	Store(*monitoring.CreateTimeSeriesRequest) error
+	// Name identifies the client.
+	Name() string
+}
+
+// stringPtr returns a pointer to s, for populating the optional string
+// fields of the generated Stackdriver API types.
+func stringPtr(s string) *string {
+	return &s
+}
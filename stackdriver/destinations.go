@@ -0,0 +1,96 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// DestinationConfig describes one Stackdriver remote-write destination,
+// analogous to a single entry of Prometheus's remote_write: [] list. Each
+// destination gets its own StorageClient (so its own project/credentials)
+// and its own write_relabel_configs, so a series can be kept out of one
+// destination while still being shipped to another.
+type DestinationConfig struct {
+	Name            string
+	QueueConfig     config.QueueConfig
+	ExternalLabels  labels.Labels
+	RelabelConfigs  []*config.RelabelConfig
+	SampleRateLimit float64
+	Client          StorageClient
+}
+
+// Destinations fans a single stream of scraped samples out to a set of
+// independently configured Stackdriver destinations. Each destination owns
+// its own QueueManager -- its own WAL, shards and relabeling -- so a slow or
+// down destination only back-pressures through its own queue, never the
+// others.
+type Destinations struct {
+	queues []*QueueManager
+}
+
+// NewDestinations builds a Destinations from one QueueManager per entry in
+// cfgs.
+func NewDestinations(logger log.Logger, cfgs []DestinationConfig) *Destinations {
+	queues := make([]*QueueManager, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		queues = append(queues, NewQueueManager(logger, cfg.QueueConfig, cfg.ExternalLabels, cfg.RelabelConfigs, cfg.SampleRateLimit, cfg.Client))
+	}
+	return &Destinations{queues: queues}
+}
+
+// Start starts every destination's QueueManager.
+func (d *Destinations) Start() {
+	for _, q := range d.queues {
+		q.Start()
+	}
+}
+
+// Stop stops every destination's QueueManager.
+func (d *Destinations) Stop() {
+	for _, q := range d.queues {
+		q.Stop()
+	}
+}
+
+// Append hands mf to every destination concurrently. Each destination
+// applies its own relabeling and its own back-pressure, so Append only
+// returns once every destination has either durably queued the series or
+// dropped it via relabeling; a destination whose queue is full blocks
+// exactly as it would through a lone QueueManager, but fanning out in
+// parallel keeps that block from also stalling delivery to the others.
+func (d *Destinations) Append(mf *dto.MetricFamily) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(d.queues))
+	wg.Add(len(d.queues))
+	for i, q := range d.queues {
+		go func(i int, q *QueueManager) {
+			defer wg.Done()
+			errs[i] = q.Append(mf)
+		}(i, q)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
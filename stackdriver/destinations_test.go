@@ -0,0 +1,74 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestDestinationsFanOut(t *testing.T) {
+	primary := NewTestStorageClient()
+	secondary := NewTestStorageClient()
+
+	primary.expectSamples([]sample{{Name: "test_metric_0", Value: 0}})
+	secondary.expectSamples([]sample{{Name: "test_metric_0", Value: 0}})
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 1
+	d := NewDestinations(nil, []DestinationConfig{
+		{Name: "primary", QueueConfig: cfg, Client: primary},
+		{Name: "secondary", QueueConfig: cfg, Client: secondary},
+	})
+	d.Start()
+	defer d.Stop()
+
+	d.Append(sampleToMetricFamily(sample{Name: "test_metric_0", Value: 0}))
+
+	primary.waitForExpectedSamples(t)
+	secondary.waitForExpectedSamples(t)
+}
+
+func TestDestinationsPerDestinationRelabel(t *testing.T) {
+	primary := NewTestStorageClient()
+	secondary := NewTestStorageClient()
+
+	primary.expectSamples([]sample{{Name: "test_metric_0", Value: 0}})
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 1
+	// secondary drops every series; primary keeps its default config and
+	// receives the sample untouched.
+	dropAll := []*config.RelabelConfig{{
+		SourceLabels: labels.LabelNames{"__name__"},
+		Regex:        config.MustNewRegexp(".*"),
+		Action:       config.RelabelDrop,
+	}}
+	d := NewDestinations(nil, []DestinationConfig{
+		{Name: "primary", QueueConfig: cfg, Client: primary},
+		{Name: "secondary", QueueConfig: cfg, RelabelConfigs: dropAll, Client: secondary},
+	})
+	d.Start()
+	defer d.Stop()
+
+	d.Append(sampleToMetricFamily(sample{Name: "test_metric_0", Value: 0}))
+
+	primary.waitForExpectedSamples(t)
+
+	if len(secondary.receivedSamples) != 0 {
+		t.Fatalf("expected secondary destination to drop all samples, got %v", secondary.receivedSamples)
+	}
+}
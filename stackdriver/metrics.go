@@ -0,0 +1,124 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+)
+
+// destinationLabel names the label every stackdriver_* metric below is
+// keyed by: the StorageClient's own Name(), so a process pushing to
+// several destinations (see Destinations) gets one set of series per
+// destination rather than one blended total.
+const destinationLabel = "destination"
+
+var (
+	samplesInTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stackdriver_samples_in_total",
+		Help: "Samples QueueManager.Append queued after relabeling; samples relabeling drops are not counted here.",
+	}, []string{destinationLabel})
+
+	samplesOutTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stackdriver_samples_out_total",
+		Help: "Samples successfully sent to Stackdriver.",
+	}, []string{destinationLabel})
+
+	samplesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stackdriver_samples_dropped_total",
+		Help: "Samples dropped by this destination's write_relabel_configs before ever reaching the WAL.",
+	}, []string{destinationLabel})
+
+	failedSamplesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stackdriver_failed_samples_total",
+		Help: "Samples in batches whose Store call failed, by response code (\"unknown\" for errors without one).",
+	}, []string{destinationLabel, "code"})
+
+	sendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stackdriver_send_duration_seconds",
+		Help:    "Time spent in a single StorageClient.Store call.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{destinationLabel})
+
+	shardsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stackdriver_shards",
+		Help: "Current number of shards the adaptive resharder has settled on.",
+	}, []string{destinationLabel})
+
+	queueLengthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stackdriver_queue_length",
+		Help: "Samples currently buffered in this destination's shard queues, summed across shards.",
+	}, []string{destinationLabel})
+)
+
+func init() {
+	prometheus.MustRegister(
+		samplesInTotal,
+		samplesOutTotal,
+		samplesDroppedTotal,
+		failedSamplesTotal,
+		sendDuration,
+		shardsGauge,
+		queueLengthGauge,
+	)
+}
+
+// name is the label value every metric this QueueManager reports is
+// recorded under.
+func (t *QueueManager) name() string {
+	return t.client.Name()
+}
+
+// storeErrorCode extracts a response code to label stackdriver_failed_*
+// with, falling back to "unknown" for errors that didn't come from the
+// Stackdriver API itself (e.g. a context deadline or a network error).
+func storeErrorCode(err error) string {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return strconv.Itoa(apiErr.Code)
+	}
+	return "unknown"
+}
+
+// shardBacklog returns the number of samples currently buffered in each
+// shard, in shard order. It exists for /debug/queue -- an incident
+// responder trying to tell "Stackdriver is slow" from "one shard is stuck"
+// needs the per-shard breakdown, not just the sum queueLengthGauge reports.
+func (t *QueueManager) shardBacklog() []int {
+	t.shardsMtx.RLock()
+	defer t.shardsMtx.RUnlock()
+	backlog := make([]int, len(t.shards.queues))
+	for i, q := range t.shards.queues {
+		backlog[i] = len(q)
+	}
+	return backlog
+}
+
+// DebugQueueHandler dumps the per-shard backlog of every destination as
+// JSON, keyed by destination name, for incident debugging.
+func (d *Destinations) DebugQueueHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backlog := make(map[string][]int, len(d.queues))
+		for _, q := range d.queues {
+			backlog[q.name()] = q.shardBacklog()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(backlog); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/config"
+)
+
+func TestMetricsTrackAppendAndDelivery(t *testing.T) {
+	c := NewTestStorageClient()
+	c.expectSamples([]sample{{Name: "test_metric_0", Value: 0}})
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 1
+	m := NewQueueManager(nil, cfg, nil, nil, 0, c)
+	destination := m.name()
+
+	before := testutil.ToFloat64(samplesInTotal.WithLabelValues(destination))
+
+	m.Start()
+	defer m.Stop()
+	m.Append(sampleToMetricFamily(sample{Name: "test_metric_0", Value: 0}))
+	c.waitForExpectedSamples(t)
+
+	if got := testutil.ToFloat64(samplesInTotal.WithLabelValues(destination)); got != before+1 {
+		t.Fatalf("expected stackdriver_samples_in_total to advance by 1, got %v -> %v", before, got)
+	}
+	if got := testutil.ToFloat64(samplesOutTotal.WithLabelValues(destination)); got < 1 {
+		t.Fatalf("expected stackdriver_samples_out_total to advance after a delivered sample, got %v", got)
+	}
+}
+
+func TestMetricsTrackRelabelDrops(t *testing.T) {
+	c := NewTestStorageClient()
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 1
+	dropAll := []*config.RelabelConfig{{
+		SourceLabels: nil,
+		Regex:        config.MustNewRegexp(".*"),
+		Action:       config.RelabelDrop,
+	}}
+	m := NewQueueManager(nil, cfg, nil, dropAll, 0, c)
+	destination := m.name()
+
+	before := testutil.ToFloat64(samplesDroppedTotal.WithLabelValues(destination))
+
+	m.Append(sampleToMetricFamily(sample{Name: "test_metric_1", Value: 0}))
+
+	if got := testutil.ToFloat64(samplesDroppedTotal.WithLabelValues(destination)); got != before+1 {
+		t.Fatalf("expected stackdriver_samples_dropped_total to advance by 1, got %v -> %v", before, got)
+	}
+}
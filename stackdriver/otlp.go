@@ -0,0 +1,320 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+// Appender is the subset of QueueManager/Destinations an ingestion path
+// needs: something that durably queues a decoded MetricFamily. Scrape-based
+// ingestion and OTLPReceiver both end at an Appender, so neither has to
+// know anything about the other.
+type Appender interface {
+	Append(*dto.MetricFamily) error
+}
+
+// OTLPResourceMapping projects a single OTel resource attribute onto one of
+// the `_kubernetes_*` labels this module's external-label handling already
+// expects (see labelsForMetric).
+type OTLPResourceMapping struct {
+	// Attribute is the OTel resource attribute key, e.g. "k8s.pod.name".
+	Attribute string
+	// Label is the Prometheus label it becomes, e.g. "_kubernetes_pod_name".
+	Label string
+}
+
+// OTLPReceiver is an http.Handler that accepts OTLP/HTTP metric exports,
+// protobuf or JSON, and feeds the decoded samples to an Appender through
+// the same path scrape-based ingestion uses.
+//
+// Its one piece of extra bookkeeping is start-timestamp tracking: an OTLP
+// cumulative point's StartTimeUnixNano is the closest thing to Stackdriver's
+// own CUMULATIVE MetricInterval.StartTime, but this module's Append/Store
+// path has no field for it. So instead of synthesizing a reset timestamp
+// per series the way scrape ingestion has to, the receiver remembers the
+// last StartTimeUnixNano seen per series and, the moment it advances,
+// emits a zero-valued sample at the new start before the real point --
+// that's the signal a reset happened, expressed the same way any other
+// sample is.
+type OTLPReceiver struct {
+	appender Appender
+	mapping  []OTLPResourceMapping
+
+	startsMtx sync.Mutex
+	starts    map[uint64]int64 // series hash -> last seen StartTimeUnixNano
+}
+
+// NewOTLPReceiver builds an OTLPReceiver that appends to appender, applying
+// mapping to project OTel resource attributes onto `_kubernetes_*` labels.
+func NewOTLPReceiver(appender Appender, mapping []OTLPResourceMapping) *OTLPReceiver {
+	return &OTLPReceiver{
+		appender: appender,
+		mapping:  mapping,
+		starts:   map[uint64]int64{},
+	}
+}
+
+// ServeHTTP decodes an OTLP/HTTP export request -- protobuf by default,
+// JSON if the client says so -- and appends every resulting sample.
+func (o *OTLPReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := pmetricotlp.NewExportRequest()
+	if r.Header.Get("Content-Type") == "application/json" {
+		err = req.UnmarshalJSON(body)
+	} else {
+		err = req.UnmarshalProto(body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("stackdriver: invalid OTLP metrics payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, mf := range o.convert(req.Metrics()) {
+		if err := o.appender.Append(mf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// convert walks every data point in metrics and returns one MetricFamily
+// per resulting sample (plus, where a series' start timestamp has just
+// advanced, one more for the created-timestamp marker). Gauges and sums map
+// straight onto dto GAUGE/COUNTER values; summaries and explicit
+// histograms follow the same name_quantile{quantile="..."} /
+// name_bucket{le="..."} convention Prometheus itself uses for them, since
+// that's what every series-per-point field in this module already expects.
+func (o *OTLPReceiver) convert(metrics pmetric.Metrics) []*dto.MetricFamily {
+	var out []*dto.MetricFamily
+
+	rms := metrics.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		rm := rms.At(i)
+		resourceLabels := o.projectResource(rm.Resource().Attributes())
+
+		sms := rm.ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			ms := sms.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				out = append(out, o.convertMetric(ms.At(k), resourceLabels)...)
+			}
+		}
+	}
+	return out
+}
+
+// projectResource turns attrs into label pairs via o.mapping; attributes
+// with no matching mapping entry are dropped rather than passed through
+// verbatim, since an unmapped OTel resource attribute has no Stackdriver
+// label convention to land on.
+func (o *OTLPReceiver) projectResource(attrs pcommon.Map) []*dto.LabelPair {
+	if len(o.mapping) == 0 {
+		return nil
+	}
+	labels := make([]*dto.LabelPair, 0, len(o.mapping))
+	for _, m := range o.mapping {
+		if v, ok := attrs.Get(m.Attribute); ok {
+			labels = append(labels, &dto.LabelPair{
+				Name:  stringPtr(m.Label),
+				Value: stringPtr(v.AsString()),
+			})
+		}
+	}
+	return labels
+}
+
+func (o *OTLPReceiver) convertMetric(m pmetric.Metric, resourceLabels []*dto.LabelPair) []*dto.MetricFamily {
+	switch m.Type() {
+	case pmetric.MetricTypeGauge:
+		return o.convertNumberPoints(m.Name(), dto.MetricType_GAUGE, m.Gauge().DataPoints(), resourceLabels)
+	case pmetric.MetricTypeSum:
+		sum := m.Sum()
+		typ := dto.MetricType_GAUGE
+		if sum.IsMonotonic() && sum.AggregationTemporality() == pmetric.AggregationTemporalityCumulative {
+			typ = dto.MetricType_COUNTER
+		}
+		return o.convertNumberPoints(m.Name(), typ, sum.DataPoints(), resourceLabels)
+	case pmetric.MetricTypeHistogram:
+		return o.convertHistogramPoints(m.Name(), m.Histogram().DataPoints(), resourceLabels)
+	case pmetric.MetricTypeSummary:
+		return o.convertSummaryPoints(m.Name(), m.Summary().DataPoints(), resourceLabels)
+	default:
+		// Exponential histograms have no direct Prometheus-exposition
+		// equivalent; dropping them here is no worse than dropping a
+		// scrape target's unsupported metric type today.
+		return nil
+	}
+}
+
+func (o *OTLPReceiver) convertNumberPoints(name string, typ dto.MetricType, dps pmetric.NumberDataPointSlice, resourceLabels []*dto.LabelPair) []*dto.MetricFamily {
+	var out []*dto.MetricFamily
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		v := dp.DoubleValue()
+		if dp.ValueType() == pmetric.NumberDataPointValueTypeInt {
+			v = float64(dp.IntValue())
+		}
+		labels := append(append([]*dto.LabelPair{}, resourceLabels...), attributeLabels(dp.Attributes())...)
+		out = append(out, o.markerAndSample(name, typ, labels, dp.StartTimestamp(), dp.Timestamp(), v)...)
+	}
+	return out
+}
+
+func (o *OTLPReceiver) convertHistogramPoints(name string, dps pmetric.HistogramDataPointSlice, resourceLabels []*dto.LabelPair) []*dto.MetricFamily {
+	var out []*dto.MetricFamily
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		labels := append(append([]*dto.LabelPair{}, resourceLabels...), attributeLabels(dp.Attributes())...)
+
+		out = append(out, o.markerAndSample(name+"_sum", dto.MetricType_COUNTER, labels, dp.StartTimestamp(), dp.Timestamp(), dp.Sum())...)
+		out = append(out, o.markerAndSample(name+"_count", dto.MetricType_COUNTER, labels, dp.StartTimestamp(), dp.Timestamp(), float64(dp.Count()))...)
+
+		// counts has one more entry than bounds: counts.At(b) is the
+		// count for (bounds[b-1], bounds[b]], and the final entry,
+		// counts.At(bounds.Len()), is the overflow bucket for
+		// everything above the last explicit bound. That overflow
+		// entry is what becomes the le="+Inf" bucket -- Prometheus
+		// requires one on every histogram, and omitting it would
+		// undercount the last finite bucket relative to _count.
+		bounds := dp.ExplicitBounds()
+		counts := dp.BucketCounts()
+		var cumulative uint64
+		for b := 0; b < bounds.Len(); b++ {
+			cumulative += counts.At(b)
+			bucketLabels := append(append([]*dto.LabelPair{}, labels...), &dto.LabelPair{
+				Name:  stringPtr("le"),
+				Value: stringPtr(fmt.Sprintf("%g", bounds.At(b))),
+			})
+			out = append(out, o.markerAndSample(name+"_bucket", dto.MetricType_COUNTER, bucketLabels, dp.StartTimestamp(), dp.Timestamp(), float64(cumulative))...)
+		}
+		cumulative += counts.At(bounds.Len())
+		infLabels := append(append([]*dto.LabelPair{}, labels...), &dto.LabelPair{
+			Name:  stringPtr("le"),
+			Value: stringPtr("+Inf"),
+		})
+		out = append(out, o.markerAndSample(name+"_bucket", dto.MetricType_COUNTER, infLabels, dp.StartTimestamp(), dp.Timestamp(), float64(cumulative))...)
+	}
+	return out
+}
+
+func (o *OTLPReceiver) convertSummaryPoints(name string, dps pmetric.SummaryDataPointSlice, resourceLabels []*dto.LabelPair) []*dto.MetricFamily {
+	var out []*dto.MetricFamily
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		labels := append(append([]*dto.LabelPair{}, resourceLabels...), attributeLabels(dp.Attributes())...)
+
+		out = append(out, o.markerAndSample(name+"_sum", dto.MetricType_COUNTER, labels, dp.StartTimestamp(), dp.Timestamp(), dp.Sum())...)
+		out = append(out, o.markerAndSample(name+"_count", dto.MetricType_COUNTER, labels, dp.StartTimestamp(), dp.Timestamp(), float64(dp.Count()))...)
+
+		qv := dp.QuantileValues()
+		for q := 0; q < qv.Len(); q++ {
+			quantileLabels := append(append([]*dto.LabelPair{}, labels...), &dto.LabelPair{
+				Name:  stringPtr("quantile"),
+				Value: stringPtr(fmt.Sprintf("%g", qv.At(q).Quantile())),
+			})
+			out = append(out, o.markerAndSample(name, dto.MetricType_GAUGE, quantileLabels, dp.StartTimestamp(), dp.Timestamp(), qv.At(q).Value())...)
+		}
+	}
+	return out
+}
+
+// markerAndSample returns the real (name, labels, v) sample at ts, preceded
+// by a zero-valued marker at start if this series' start timestamp has
+// advanced since the last point seen for it. A series that has never been
+// seen before counts as an advance, so the very first point of a new
+// series also gets a created-timestamp marker.
+func (o *OTLPReceiver) markerAndSample(name string, typ dto.MetricType, labels []*dto.LabelPair, start, ts pcommon.Timestamp, v float64) []*dto.MetricFamily {
+	key := seriesKey(name, labels)
+	startNanos := int64(start)
+
+	o.startsMtx.Lock()
+	last, seen := o.starts[key]
+	advanced := !seen || startNanos != last
+	if advanced {
+		o.starts[key] = startNanos
+	}
+	o.startsMtx.Unlock()
+
+	sample := []*dto.MetricFamily{newMetricFamily(name, typ, labels, int64(ts)/1e6, v)}
+	if !advanced {
+		return sample
+	}
+	marker := newMetricFamily(name, typ, labels, startNanos/1e6, 0)
+	return append([]*dto.MetricFamily{marker}, sample...)
+}
+
+// seriesKey hashes name+labels into a stable key so two points belonging
+// to the same series always land on the same start-timestamp entry,
+// regardless of attribute ordering.
+func seriesKey(name string, lp []*dto.LabelPair) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	for _, l := range lp {
+		h.Write([]byte{0})
+		h.Write([]byte(l.GetName()))
+		h.Write([]byte{0})
+		h.Write([]byte(l.GetValue()))
+	}
+	return h.Sum64()
+}
+
+// attributeLabels converts attrs into label pairs, sorted by name. Map
+// iteration order is unspecified, and markerAndSample hashes the label
+// list to key its start-timestamp cache -- an unsorted list would hash
+// differently from one call to the next for the very same series.
+func attributeLabels(attrs pcommon.Map) []*dto.LabelPair {
+	labels := make([]*dto.LabelPair, 0, attrs.Len())
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		labels = append(labels, &dto.LabelPair{Name: stringPtr(k), Value: stringPtr(v.AsString())})
+		return true
+	})
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
+
+func newMetricFamily(name string, typ dto.MetricType, labels []*dto.LabelPair, tsMillis int64, v float64) *dto.MetricFamily {
+	metric := &dto.Metric{
+		Label:       labels,
+		TimestampMs: proto.Int64(tsMillis),
+	}
+	switch typ {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(v)}
+	default:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+	}
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   typ.Enum(),
+		Metric: []*dto.Metric{metric},
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestSeriesKeyDeterministic(t *testing.T) {
+	labels := []*dto.LabelPair{
+		{Name: stringPtr("a"), Value: stringPtr("1")},
+		{Name: stringPtr("b"), Value: stringPtr("2")},
+	}
+	other := []*dto.LabelPair{
+		{Name: stringPtr("a"), Value: stringPtr("1")},
+		{Name: stringPtr("b"), Value: stringPtr("3")},
+	}
+
+	if seriesKey("test", labels) != seriesKey("test", labels) {
+		t.Fatalf("seriesKey is not deterministic for identical input")
+	}
+	if seriesKey("test", labels) == seriesKey("test", other) {
+		t.Fatalf("expected a different value for label \"b\" to change the key")
+	}
+}
+
+func TestMarkerAndSampleEmitsMarkerOnStartAdvance(t *testing.T) {
+	o := NewOTLPReceiver(nil, nil)
+	labels := []*dto.LabelPair{{Name: stringPtr("job"), Value: stringPtr("test")}}
+
+	first := o.markerAndSample("test_metric", dto.MetricType_GAUGE, labels, 1000, 2000, 5)
+	if len(first) != 2 {
+		t.Fatalf("expected a created-timestamp marker plus the sample for a never-before-seen series, got %d metric families", len(first))
+	}
+	if got := first[0].GetMetric()[0].GetGauge().GetValue(); got != 0 {
+		t.Fatalf("expected the marker sample to be zero-valued, got %v", got)
+	}
+
+	second := o.markerAndSample("test_metric", dto.MetricType_GAUGE, labels, 1000, 3000, 6)
+	if len(second) != 1 {
+		t.Fatalf("expected no marker once the start timestamp is unchanged, got %d metric families", len(second))
+	}
+
+	third := o.markerAndSample("test_metric", dto.MetricType_GAUGE, labels, 4000, 5000, 7)
+	if len(third) != 2 {
+		t.Fatalf("expected a new marker once the start timestamp advances, got %d metric families", len(third))
+	}
+}
+
+// bucketValue returns the value of the last name_bucket family carrying
+// le=le in out, and whether it was found at all. The last one is the real
+// sample: a created-timestamp marker for the same series comes before it.
+func bucketValue(out []*dto.MetricFamily, name, le string) (float64, bool) {
+	var (
+		value float64
+		found bool
+	)
+	for _, mf := range out {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			if lp.GetName() == "le" && lp.GetValue() == le {
+				value, found = mf.GetMetric()[0].GetCounter().GetValue(), true
+			}
+		}
+	}
+	return value, found
+}
+
+func TestConvertHistogramEmitsOverflowBucket(t *testing.T) {
+	o := NewOTLPReceiver(nil, nil)
+
+	metrics := pmetric.NewMetrics()
+	m := metrics.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName("test_histogram")
+	hist := m.SetEmptyHistogram()
+	hist.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+
+	dp := hist.DataPoints().AppendEmpty()
+	dp.SetStartTimestamp(pcommon.Timestamp(1000 * 1e6))
+	dp.SetTimestamp(pcommon.Timestamp(2000 * 1e6))
+	dp.SetCount(10)
+	dp.SetSum(50)
+	dp.ExplicitBounds().FromRaw([]float64{1, 5})
+	// Three buckets for two explicit bounds: (-Inf, 1], (1, 5], and the
+	// overflow bucket (5, +Inf) that only counts.At(bounds.Len()) holds.
+	dp.BucketCounts().FromRaw([]uint64{2, 3, 5})
+
+	out := o.convert(metrics)
+
+	if got, ok := bucketValue(out, "test_histogram_bucket", "1"); !ok || got != 2 {
+		t.Fatalf("expected le=\"1\" bucket to be 2, got %v (found=%v)", got, ok)
+	}
+	if got, ok := bucketValue(out, "test_histogram_bucket", "5"); !ok || got != 5 {
+		t.Fatalf("expected le=\"5\" bucket to be cumulative 5, got %v (found=%v)", got, ok)
+	}
+	got, ok := bucketValue(out, "test_histogram_bucket", "+Inf")
+	if !ok {
+		t.Fatalf("expected a le=\"+Inf\" bucket, found none")
+	}
+	if got != 10 {
+		t.Fatalf("expected le=\"+Inf\" bucket to equal _count (10), got %v", got)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// walProgress is the last WAL segment the queue manager knows it has fully
+// delivered to Stackdriver: every sample in Segment, and nothing newer, has
+// received a 2xx from Store. It is only ever advanced after that 2xx --
+// advancing it earlier would let a restart skip over samples that were
+// never actually written. Segment is -1 when nothing has been checkpointed
+// yet, which replayWAL treats as "replay from the very first segment" --
+// distinct from Segment 0 meaning segment 0 itself is already acknowledged.
+type walProgress struct {
+	Segment int `json:"segment"`
+}
+
+const progressFileName = "progress.json"
+
+// readProgress loads the checkpointed WAL position from dir. A missing file
+// is treated as "nothing checkpointed yet" (Segment: -1) rather than an
+// error, since that's the normal state for a freshly created WAL directory.
+func readProgress(dir string) (walProgress, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, progressFileName))
+	if os.IsNotExist(err) {
+		return walProgress{Segment: -1}, nil
+	}
+	if err != nil {
+		return walProgress{}, err
+	}
+	var p walProgress
+	if err := json.Unmarshal(b, &p); err != nil {
+		return walProgress{}, err
+	}
+	return p, nil
+}
+
+// writeProgress atomically checkpoints p to dir so a restart resumes
+// tailing from exactly the position of the last acknowledged batch.
+func writeProgress(dir string, p walProgress) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, progressFileName+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, progressFileName))
+}
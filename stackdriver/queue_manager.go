@@ -0,0 +1,558 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb/wal"
+	"golang.org/x/time/rate"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	// walSegmentSize mirrors the Prometheus TSDB default so the WAL
+	// package's own segment-rotation logic needs no tuning here.
+	walSegmentSize = wal.DefaultSegmentSize
+
+	batchSendDeadline = 5 * time.Second
+)
+
+// QueueManager manages the queues of samples to be sent to the Stackdriver
+// API. Samples handed to Append are first made durable by writing them to
+// a Prometheus TSDB WAL, and only then handed to the in-memory shard
+// queues that runShard drains. That split is what lets a restart -- or a
+// temporary Stackdriver outage that fills the queues -- happen without
+// losing samples: anything the shards haven't gotten to yet is still on
+// disk and gets replayed when a QueueManager is started over the same
+// walDir. NewQueueManager always creates a fresh temporary walDir, so a
+// new process does not find an earlier process's WAL by itself.
+type QueueManager struct {
+	logger log.Logger
+	cfg    config.QueueConfig
+	client StorageClient
+
+	externalLabels labels.Labels
+	relabelConfigs []*config.RelabelConfig
+
+	// minShards and maxShards bound the shard count the resharder is
+	// allowed to pick; sampleRateLimit throttles each shard's Store calls
+	// to that many samples/sec via a token-bucket limiter.
+	minShards, maxShards int
+	sampleRateLimit      rate.Limit
+
+	walDir string
+	wal    *wal.WAL
+
+	seriesMtx   sync.Mutex
+	seriesCache map[seriesRef]labels.Labels
+	seriesByKey map[uint64]seriesRef
+	nextRef     uint64
+
+	shardsMtx sync.RWMutex
+	shards    *shards
+
+	// samplesIn and samplesOut feed the resharder's EWMA of in/out rate;
+	// they're updated atomically from Append and sendSamples so they can
+	// be read without taking shardsMtx.
+	samplesIn, samplesOut uint64
+
+	resharder *resharder
+
+	progressMtx sync.Mutex
+	progress    walProgress
+}
+
+// NewQueueManager builds a new QueueManager. externalLabels is attached to
+// every series before it is written to Stackdriver. relabelConfigs is this
+// destination's own write_relabel_configs, applied (in the same way
+// relabel.Process is applied to scrape-time relabeling) before a sample is
+// durably queued, so a series dropped by it never touches the WAL at all.
+// sampleRateLimit caps the samples per second each shard may send to
+// Stackdriver; zero disables rate limiting.
+func NewQueueManager(logger log.Logger, cfg config.QueueConfig, externalLabels labels.Labels, relabelConfigs []*config.RelabelConfig, sampleRateLimit float64, client StorageClient) *QueueManager {
+	if logger == nil {
+		logger = log.Base()
+	}
+
+	dir, err := ioutil.TempDir("", "stackdriver-wal-")
+	if err != nil {
+		// The WAL directory is only a durability aid: without it
+		// walDir stays empty and no WAL is opened at all, but
+		// samples can still flow through the shard queues.
+		logger.With("err", err).Error("failed to create WAL directory, falling back to no-op WAL")
+		dir = ""
+	}
+
+	minShards, maxShards := cfg.MinShards, cfg.MaxShards
+	if maxShards <= 0 {
+		maxShards = 1
+	}
+	if minShards <= 0 || minShards > maxShards {
+		minShards = maxShards
+	}
+
+	limit := rate.Limit(sampleRateLimit)
+	if sampleRateLimit <= 0 {
+		limit = rate.Inf
+	}
+
+	t := &QueueManager{
+		logger:          logger,
+		cfg:             cfg,
+		client:          client,
+		externalLabels:  externalLabels,
+		relabelConfigs:  relabelConfigs,
+		minShards:       minShards,
+		maxShards:       maxShards,
+		sampleRateLimit: limit,
+		walDir:          dir,
+		seriesCache:     map[seriesRef]labels.Labels{},
+		seriesByKey:     map[uint64]seriesRef{},
+	}
+	t.shards = t.newShards(minShards)
+	t.resharder = newResharder(t)
+	shardsGauge.WithLabelValues(t.name()).Set(float64(minShards))
+	return t
+}
+
+// Append queues a sample for sending to Stackdriver. It first runs this
+// destination's write_relabel_configs over the series -- a series dropped
+// there is skipped entirely, before it ever reaches the WAL -- then
+// durably records the sample and hands it to the shard queue that owns
+// its series; that second step blocks, rather than dropping the sample,
+// once the queue is full, which is what makes a bursty or slow downstream
+// apply back-pressure to the scrape loop instead of silently losing data.
+func (t *QueueManager) Append(mf *dto.MetricFamily) error {
+	for _, m := range mf.GetMetric() {
+		v, ok := metricValue(mf, m)
+		if !ok {
+			continue
+		}
+		lset := labelsForMetric(mf.GetName(), m, t.externalLabels)
+		if len(t.relabelConfigs) > 0 {
+			lset = relabel.Process(lset, t.relabelConfigs...)
+			if lset == nil {
+				samplesDroppedTotal.WithLabelValues(t.name()).Inc()
+				continue
+			}
+		}
+		ts := m.GetTimestampMs()
+		if ts == 0 {
+			ts = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+
+		ref := t.refFor(lset)
+		seg, err := t.persist(ref, ts, v)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&t.samplesIn, 1)
+		samplesInTotal.WithLabelValues(t.name()).Inc()
+		t.enqueue(refSample{ref: ref, t: ts, v: v, seg: seg})
+	}
+	return nil
+}
+
+// refFor returns the seriesRef for lset, assigning and caching a new one
+// (and writing its series record to the WAL) the first time a series is
+// seen. Reusing the ref for every subsequent sample is what keeps the WAL
+// -- and the seriesCache that mirrors it -- from growing with every
+// scrape: only the much smaller (ref, t, v) triples repeat.
+func (t *QueueManager) refFor(lset labels.Labels) seriesRef {
+	key := lset.Hash()
+
+	t.seriesMtx.Lock()
+	defer t.seriesMtx.Unlock()
+
+	if ref, ok := t.seriesByKey[key]; ok {
+		return ref
+	}
+
+	t.nextRef++
+	ref := seriesRef(t.nextRef)
+	t.seriesByKey[key] = ref
+	t.seriesCache[ref] = lset
+
+	if t.wal != nil {
+		rec := encodeSeries(nil, ref, lset)
+		if err := t.wal.Log(rec); err != nil {
+			t.logger.With("err", err).Error("failed to log series record")
+		}
+	}
+	return ref
+}
+
+func (t *QueueManager) cacheSeries(ref seriesRef, lset labels.Labels) {
+	t.seriesMtx.Lock()
+	defer t.seriesMtx.Unlock()
+	t.seriesCache[ref] = lset
+	t.seriesByKey[lset.Hash()] = ref
+	if uint64(ref) > t.nextRef {
+		t.nextRef = uint64(ref)
+	}
+}
+
+func (t *QueueManager) labelsFor(ref seriesRef) (labels.Labels, bool) {
+	t.seriesMtx.Lock()
+	defer t.seriesMtx.Unlock()
+	lset, ok := t.seriesCache[ref]
+	return lset, ok
+}
+
+// persist durably writes the sample to the WAL and returns the index of
+// the segment it landed in, so the caller can track that sample's
+// outstanding position until it's acknowledged by Stackdriver (see
+// shards.segQueues and checkpoint).
+func (t *QueueManager) persist(ref seriesRef, ts int64, v float64) (int64, error) {
+	if t.wal == nil {
+		return 0, nil
+	}
+	rec := encodeSamples(nil, []refSample{{ref: ref, t: ts, v: v}})
+	if err := t.wal.Log(rec); err != nil {
+		return 0, err
+	}
+	_, last, err := wal.Segments(t.walDir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(last), nil
+}
+
+// enqueue hands a decoded sample to the shard that owns its series,
+// blocking until there is room. This is the sole back-pressure point in
+// the pipeline: everything upstream of it (scrape loops, relabeling)
+// stalls with it rather than buffering unboundedly or dropping silently.
+//
+// shardsMtx is held for the whole send, not just the read of t.shards --
+// releasing it early would let this goroutine sit in shards.enqueue's
+// select against a *shards that reshardTo has already started quiescing,
+// which can pick the channel-send case over <-done and write the sample
+// into a queue nobody will ever read again. Holding the RLock here makes
+// reshardTo's Lock() wait for every in-flight enqueue to finish choosing
+// its shard set before a quiesce can begin.
+func (t *QueueManager) enqueue(s refSample) {
+	t.shardsMtx.RLock()
+	defer t.shardsMtx.RUnlock()
+	t.shards.enqueue(s)
+}
+
+// Start opens the WAL, starts the per-shard send goroutines, and then
+// replays anything left over from a previous run that was never
+// acknowledged by Stackdriver. The shards have to be draining before the
+// replay runs: recoveryTailer.run() feeds a backlog through the same
+// blocking enqueue path live Append uses, and a backlog larger than a
+// single shard's buffer would deadlock here forever against channels
+// nothing is reading yet -- exactly the restart-after-an-outage case this
+// whole WAL exists for.
+func (t *QueueManager) Start() {
+	if t.walDir != "" {
+		w, err := wal.NewSize(t.logger, nil, t.walDir, walSegmentSize, false)
+		if err != nil {
+			t.logger.With("err", err).Error("failed to open WAL, continuing without durability")
+		} else {
+			t.wal = w
+		}
+	}
+
+	t.shards.start()
+	t.resharder.start()
+
+	if t.walDir != "" {
+		if err := newRecoveryTailer(t).run(); err != nil {
+			t.logger.With("err", err).Error("failed to replay WAL")
+		}
+	}
+}
+
+// Stop stops the resharder, then quiesces the shards -- draining whatever
+// they're holding so a shutdown never loses an in-flight sample -- and
+// closes the WAL. The WAL directory itself is left on disk: a QueueManager
+// later started over the same walDir resumes from where this one left off.
+func (t *QueueManager) Stop() {
+	t.resharder.stop()
+	t.shards.stop()
+	if t.wal != nil {
+		t.wal.Close()
+	}
+}
+
+// currentShards returns the number of shards currently in use.
+func (t *QueueManager) currentShards() int {
+	t.shardsMtx.RLock()
+	defer t.shardsMtx.RUnlock()
+	return len(t.shards.queues)
+}
+
+// reshardTo replaces the current shard set with n new shards. The old
+// shards are quiesced -- drained through Store -- before the new ones are
+// installed and started; shardsMtx is held for the whole swap so Append
+// can't hand a sample to a shard that is mid-quiesce and about to discard
+// it.
+func (t *QueueManager) reshardTo(n int) {
+	t.shardsMtx.Lock()
+	defer t.shardsMtx.Unlock()
+
+	t.shards.stop()
+	t.shards = t.newShards(n)
+	t.shards.start()
+	shardsGauge.WithLabelValues(t.name()).Set(float64(n))
+}
+
+// shards owns the current set of channels samples are sharded across, and
+// the goroutines that drain them.
+type shards struct {
+	qm     *QueueManager
+	queues []chan refSample
+
+	// segMtx guards segQueues, one per shard: the WAL segment each
+	// not-yet-acknowledged sample in that shard was persisted to, oldest
+	// first. checkpoint() uses the head of these to find the oldest WAL
+	// position still outstanding anywhere, since a batch sitting
+	// unsent in a backlogged shard must not be checkpointed past just
+	// because some other, faster shard's batch happened to succeed.
+	segMtx    sync.Mutex
+	segQueues [][]int64
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func (t *QueueManager) newShards(n int) *shards {
+	queues := make([]chan refSample, n)
+	for i := range queues {
+		queues[i] = make(chan refSample, t.cfg.Capacity)
+	}
+	return &shards{
+		qm:        t,
+		queues:    queues,
+		segQueues: make([][]int64, n),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *shards) enqueue(sample refSample) {
+	i := int(sample.ref) % len(s.queues)
+	select {
+	case s.queues[i] <- sample:
+		s.segMtx.Lock()
+		s.segQueues[i] = append(s.segQueues[i], sample.seg)
+		s.segMtx.Unlock()
+	case <-s.done:
+	}
+}
+
+// ackSegments removes the n oldest outstanding segment entries for shard
+// i, called once that shard's batch of n samples has received a 2xx from
+// Store.
+func (s *shards) ackSegments(i, n int) {
+	s.segMtx.Lock()
+	defer s.segMtx.Unlock()
+	if n > len(s.segQueues[i]) {
+		n = len(s.segQueues[i])
+	}
+	s.segQueues[i] = s.segQueues[i][n:]
+}
+
+// oldestOutstandingSegment returns the lowest WAL segment index that some
+// shard still has an unacknowledged sample in, across every shard. The
+// second return value is false if nothing is currently outstanding.
+func (s *shards) oldestOutstandingSegment() (int64, bool) {
+	s.segMtx.Lock()
+	defer s.segMtx.Unlock()
+	var (
+		oldest int64
+		found  bool
+	)
+	for _, q := range s.segQueues {
+		if len(q) == 0 {
+			continue
+		}
+		if !found || q[0] < oldest {
+			oldest = q[0]
+			found = true
+		}
+	}
+	return oldest, found
+}
+
+func (s *shards) start() {
+	s.wg.Add(len(s.queues))
+	for i := range s.queues {
+		go s.runShard(i)
+	}
+}
+
+func (s *shards) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// runShard drains one shard's queue, batching samples up to
+// MaxSamplesPerSend (or until batchSendDeadline elapses) before calling
+// Store. A single in-flight Store call per shard is the mechanism that
+// keeps TestSpawnNotMoreThanMaxConcurrentSendsGoroutines honest: the next
+// batch isn't read off the queue until the previous one has been
+// acknowledged.
+func (s *shards) runShard(i int) {
+	defer s.wg.Done()
+
+	queue := s.queues[i]
+	max := s.qm.cfg.MaxSamplesPerSend
+	if max <= 0 {
+		max = 1
+	}
+	limiter := rate.NewLimiter(s.qm.sampleRateLimit, max)
+
+	timer := time.NewTimer(batchSendDeadline)
+	defer timer.Stop()
+
+	pending := make([]refSample, 0, max)
+	for {
+		select {
+		case sample, ok := <-queue:
+			if !ok {
+				return
+			}
+			pending = append(pending, sample)
+			if len(pending) < max {
+				continue
+			}
+			s.qm.sendSamples(s, i, pending, limiter)
+			pending = pending[:0]
+			timer.Reset(batchSendDeadline)
+
+		case <-timer.C:
+			if len(pending) > 0 {
+				s.qm.sendSamples(s, i, pending, limiter)
+				pending = pending[:0]
+			}
+			timer.Reset(batchSendDeadline)
+
+		case <-s.done:
+			// Drain whatever is left so a quiesce (reshard or
+			// shutdown) never drops in-flight samples.
+			for {
+				select {
+				case sample, ok := <-queue:
+					if !ok {
+						if len(pending) > 0 {
+							s.qm.sendSamples(s, i, pending, limiter)
+						}
+						return
+					}
+					pending = append(pending, sample)
+					if len(pending) >= max {
+						s.qm.sendSamples(s, i, pending, limiter)
+						pending = pending[:0]
+					}
+				default:
+					if len(pending) > 0 {
+						s.qm.sendSamples(s, i, pending, limiter)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendSamples converts a batch of refSamples into a CreateTimeSeriesRequest
+// and ships it to Stackdriver, then advances the WAL checkpoint. The
+// checkpoint is only ever moved forward after Store returns successfully
+// -- moving it earlier would let a restart skip samples that were never
+// actually delivered. s and i identify the shard batch came off of, so a
+// successful Store can retire its samples from that shard's segQueues
+// before checkpoint() looks for the oldest position still outstanding
+// across every shard. limiter throttles this shard to sampleRateLimit
+// samples/sec, so a misconfigured high-cardinality job degrades into a
+// steady trickle instead of bursting into Stackdriver 429s.
+func (t *QueueManager) sendSamples(s *shards, i int, batch []refSample, limiter *rate.Limiter) {
+	if err := limiter.WaitN(context.Background(), len(batch)); err != nil {
+		t.logger.With("err", err).Error("rate limiter wait failed")
+	}
+
+	req := &monitoring.CreateTimeSeriesRequest{
+		TimeSeries: make([]*monitoring.TimeSeries, 0, len(batch)),
+	}
+	for _, sm := range batch {
+		lset, ok := t.labelsFor(sm.ref)
+		if !ok {
+			continue
+		}
+		req.TimeSeries = append(req.TimeSeries, sampleToTimeSeries(lset, sm.t, sm.v))
+	}
+
+	start := time.Now()
+	err := t.client.Store(req)
+	sendDuration.WithLabelValues(t.name()).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		t.logger.With("client", t.client.Name()).With("err", err).Error("error sending samples to Stackdriver")
+		failedSamplesTotal.WithLabelValues(t.name(), storeErrorCode(err)).Add(float64(len(batch)))
+		return
+	}
+
+	atomic.AddUint64(&t.samplesOut, uint64(len(batch)))
+	samplesOutTotal.WithLabelValues(t.name()).Add(float64(len(batch)))
+	s.ackSegments(i, len(batch))
+	t.checkpoint(s)
+}
+
+// checkpoint advances the on-disk progress marker as far as it can safely
+// go: never past the segment the writer still has open (a segment only
+// seals once it's full, so anything in it could still be awaiting a
+// send), and never past the oldest WAL position any shard still has an
+// unacknowledged sample in. Without that second bound, one shard's
+// successful Store could advance the checkpoint past samples a different,
+// slower or backlogged shard hasn't sent yet -- and a restart would then
+// skip them, even though Stackdriver never actually received them.
+// s is the shard set the acknowledged batch came from; it is read without
+// shardsMtx, which reshardTo holds while it waits for s to drain.
+func (t *QueueManager) checkpoint(s *shards) {
+	if t.walDir == "" {
+		return
+	}
+	_, last, err := wal.Segments(t.walDir)
+	if err != nil || last <= 0 {
+		return
+	}
+
+	safe := int64(last - 1)
+	oldest, outstanding := s.oldestOutstandingSegment()
+	if outstanding && oldest-1 < safe {
+		safe = oldest - 1
+	}
+	if safe < 0 {
+		return
+	}
+
+	t.progressMtx.Lock()
+	prog := walProgress{Segment: int(safe)}
+	t.progress = prog
+	t.progressMtx.Unlock()
+
+	if err := writeProgress(t.walDir, prog); err != nil {
+		t.logger.With("err", err).Error("failed to checkpoint WAL progress")
+	}
+}
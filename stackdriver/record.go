@@ -0,0 +1,168 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// recordType identifies the kind of entry encoded in a single WAL record.
+// The WAL itself (tsdb/wal) only deals in opaque byte slices, so the queue
+// manager defines its own tiny record format on top of it.
+type recordType byte
+
+const (
+	recordInvalid recordType = 0
+	// recordSeries associates a seriesRef with the labels it stands for.
+	// It is written once, the first time Append sees a new series.
+	recordSeries recordType = 1
+	// recordSamples is a batch of (ref, timestamp, value) triples.
+	recordSamples recordType = 2
+)
+
+// seriesRef identifies a unique series within the WAL and the in-memory
+// seriesCache. It is assigned once per series and reused for every sample
+// belonging to that series, so the (much larger) label set only has to be
+// written to the WAL a single time.
+type seriesRef uint64
+
+// refSample is the decoded form of one entry in a recordSamples record.
+// seg is the WAL segment this sample was (or, on replay, was originally)
+// durably written to; it is runtime bookkeeping for checkpoint() and is
+// never itself part of the on-disk record -- decodeSamples always returns
+// it zero-valued, and replayWAL fills it in from the segment being read.
+type refSample struct {
+	ref seriesRef
+	t   int64
+	v   float64
+	seg int64
+}
+
+// encodeSeries appends a recordSeries entry for ref/lset to buf and returns
+// the extended slice.
+func encodeSeries(buf []byte, ref seriesRef, lset labels.Labels) []byte {
+	buf = append(buf, byte(recordSeries))
+	var num [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(num[:], uint64(ref))
+	buf = append(buf, num[:n]...)
+
+	n = binary.PutUvarint(num[:], uint64(len(lset)))
+	buf = append(buf, num[:n]...)
+	for _, l := range lset {
+		buf = appendString(buf, l.Name)
+		buf = appendString(buf, l.Value)
+	}
+	return buf
+}
+
+// encodeSamples appends a recordSamples entry to buf and returns the
+// extended slice.
+func encodeSamples(buf []byte, samples []refSample) []byte {
+	buf = append(buf, byte(recordSamples))
+	var num [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(num[:], uint64(len(samples)))
+	buf = append(buf, num[:n]...)
+	for _, s := range samples {
+		n = binary.PutUvarint(num[:], uint64(s.ref))
+		buf = append(buf, num[:n]...)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(s.t))
+		buf = append(buf, b[:]...)
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(s.v))
+		buf = append(buf, b[:]...)
+	}
+	return buf
+}
+
+// decodeSeries parses a recordSeries entry. rec must not include the leading
+// recordType byte.
+func decodeSeries(rec []byte) (seriesRef, labels.Labels, error) {
+	ref, n := binary.Uvarint(rec)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("stackdriver: invalid series ref")
+	}
+	rec = rec[n:]
+
+	numLabels, n := binary.Uvarint(rec)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("stackdriver: invalid label count")
+	}
+	rec = rec[n:]
+
+	lset := make(labels.Labels, 0, numLabels)
+	var name, value string
+	var err error
+	for i := uint64(0); i < numLabels; i++ {
+		name, rec, err = readString(rec)
+		if err != nil {
+			return 0, nil, err
+		}
+		value, rec, err = readString(rec)
+		if err != nil {
+			return 0, nil, err
+		}
+		lset = append(lset, labels.Label{Name: name, Value: value})
+	}
+	return seriesRef(ref), lset, nil
+}
+
+// decodeSamples parses a recordSamples entry. rec must not include the
+// leading recordType byte.
+func decodeSamples(rec []byte) ([]refSample, error) {
+	count, n := binary.Uvarint(rec)
+	if n <= 0 {
+		return nil, fmt.Errorf("stackdriver: invalid sample count")
+	}
+	rec = rec[n:]
+
+	samples := make([]refSample, 0, count)
+	for i := uint64(0); i < count; i++ {
+		ref, n := binary.Uvarint(rec)
+		if n <= 0 {
+			return nil, fmt.Errorf("stackdriver: truncated sample record")
+		}
+		rec = rec[n:]
+		if len(rec) < 16 {
+			return nil, fmt.Errorf("stackdriver: truncated sample record")
+		}
+		t := int64(binary.BigEndian.Uint64(rec[:8]))
+		v := math.Float64frombits(binary.BigEndian.Uint64(rec[8:16]))
+		rec = rec[16:]
+		samples = append(samples, refSample{ref: seriesRef(ref), t: t, v: v})
+	}
+	return samples, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	var num [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(num[:], uint64(len(s)))
+	buf = append(buf, num[:n]...)
+	return append(buf, s...)
+}
+
+func readString(rec []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(rec)
+	if n <= 0 {
+		return "", nil, fmt.Errorf("stackdriver: invalid string length")
+	}
+	rec = rec[n:]
+	if uint64(len(rec)) < l {
+		return "", nil, fmt.Errorf("stackdriver: truncated string")
+	}
+	return string(rec[:l]), rec[l:], nil
+}
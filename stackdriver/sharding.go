@@ -0,0 +1,141 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// reshardInterval is how often the resharder reevaluates the shard
+	// count against the EWMA'd in/out rates.
+	reshardInterval = 10 * time.Second
+
+	// reshardEWMAAlpha weights the most recently observed interval's rate
+	// against the running EWMA.
+	reshardEWMAAlpha = 0.2
+
+	// reshardStableTicks is how many consecutive ticks a new desired
+	// shard count has to be the answer before it's actually applied, so a
+	// momentary burst doesn't make shards flap up and down.
+	reshardStableTicks = 3
+)
+
+// resharder watches the EWMA of samples flowing into a QueueManager against
+// the EWMA of samples flowing out, and grows or shrinks the shard count to
+// keep the two in balance, within [minShards, maxShards].
+type resharder struct {
+	qm *QueueManager
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	lastTick        time.Time
+	lastIn, lastOut uint64
+	ewmaIn, ewmaOut float64
+
+	pendingShards int
+	stableTicks   int
+}
+
+func newResharder(qm *QueueManager) *resharder {
+	return &resharder{qm: qm, done: make(chan struct{})}
+}
+
+// start runs the resharder's reevaluation loop in its own goroutine.
+func (r *resharder) start() {
+	r.lastTick = time.Now()
+	r.wg.Add(1)
+	go r.run()
+}
+
+func (r *resharder) stop() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *resharder) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(reshardInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.tick()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// tick recomputes the in/out EWMAs and, if the desired shard count has been
+// stable for reshardStableTicks ticks in a row, applies it.
+func (r *resharder) tick() {
+	now := time.Now()
+	elapsed := now.Sub(r.lastTick).Seconds()
+	r.lastTick = now
+	if elapsed <= 0 {
+		return
+	}
+
+	backlog := 0
+	for _, n := range r.qm.shardBacklog() {
+		backlog += n
+	}
+	queueLengthGauge.WithLabelValues(r.qm.name()).Set(float64(backlog))
+
+	in := atomic.LoadUint64(&r.qm.samplesIn)
+	out := atomic.LoadUint64(&r.qm.samplesOut)
+	rateIn := float64(in-r.lastIn) / elapsed
+	rateOut := float64(out-r.lastOut) / elapsed
+	r.lastIn, r.lastOut = in, out
+
+	r.ewmaIn = reshardEWMAAlpha*rateIn + (1-reshardEWMAAlpha)*r.ewmaIn
+	r.ewmaOut = reshardEWMAAlpha*rateOut + (1-reshardEWMAAlpha)*r.ewmaOut
+
+	if r.ewmaOut <= 0 {
+		// Nothing has been sent yet, so inRate/outRate is meaningless;
+		// wait for the next tick rather than guessing.
+		return
+	}
+
+	current := r.qm.currentShards()
+	desired := int(math.Ceil(r.ewmaIn / r.ewmaOut * float64(current)))
+	if desired < r.qm.minShards {
+		desired = r.qm.minShards
+	}
+	if desired > r.qm.maxShards {
+		desired = r.qm.maxShards
+	}
+
+	if desired == current {
+		r.stableTicks = 0
+		return
+	}
+	if desired != r.pendingShards {
+		r.pendingShards = desired
+		r.stableTicks = 0
+	}
+	r.stableTicks++
+
+	if r.stableTicks >= reshardStableTicks {
+		r.qm.reshardTo(desired)
+		r.stableTicks = 0
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// TestAdaptiveSharding drives the resharder directly (rather than waiting
+// out real reshardInterval ticks) with a sustained 4x samples-in/out
+// imbalance and checks that shards grow to MaxShards once the desired
+// count has held for reshardStableTicks in a row.
+func TestAdaptiveSharding(t *testing.T) {
+	c := NewTestStorageClient()
+	cfg := config.DefaultQueueConfig
+	cfg.MinShards = 1
+	cfg.MaxShards = 4
+	m := NewQueueManager(nil, cfg, nil, nil, 0, c)
+
+	for i := 0; i < reshardStableTicks; i++ {
+		atomic.AddUint64(&m.samplesIn, 400)
+		atomic.AddUint64(&m.samplesOut, 100)
+		m.resharder.lastTick = time.Now().Add(-reshardInterval)
+		m.resharder.tick()
+	}
+
+	if got := m.currentShards(); got != cfg.MaxShards {
+		t.Fatalf("expected shards to grow to MaxShards (%d) under sustained backlog, got %d", cfg.MaxShards, got)
+	}
+}
+
+// TestAdaptiveShardingDoesNotFlap checks that a single noisy tick --
+// immediately followed by the in/out rates evening back out -- never
+// reaches reshardStableTicks in a row, so the shard count doesn't change.
+func TestAdaptiveShardingDoesNotFlap(t *testing.T) {
+	c := NewTestStorageClient()
+	cfg := config.DefaultQueueConfig
+	cfg.MinShards = 1
+	cfg.MaxShards = 4
+	m := NewQueueManager(nil, cfg, nil, nil, 0, c)
+
+	// One tick suggests growth...
+	atomic.AddUint64(&m.samplesIn, 400)
+	atomic.AddUint64(&m.samplesOut, 100)
+	m.resharder.lastTick = time.Now().Add(-reshardInterval)
+	m.resharder.tick()
+
+	// ...but the next ticks show in and out back in balance, so as the
+	// EWMA decays the desired count drops from 4 to 3, then 2, 2: it never
+	// holds for reshardStableTicks ticks in a row within these ticks.
+	for i := 0; i < reshardStableTicks; i++ {
+		atomic.AddUint64(&m.samplesIn, 100)
+		atomic.AddUint64(&m.samplesOut, 100)
+		m.resharder.lastTick = time.Now().Add(-reshardInterval)
+		m.resharder.tick()
+	}
+
+	if got := m.currentShards(); got != cfg.MinShards {
+		t.Fatalf("expected shard count to stay at MinShards (%d) without a stable signal, got %d", cfg.MinShards, got)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// metricValue extracts the single numeric value this module knows how to
+// ship to Stackdriver out of a dto.Metric. Summaries and histograms need
+// more than one time series per metric and are not unpacked here: it
+// reports false for them, and Append skips such metrics.
+func metricValue(mf *dto.MetricFamily, m *dto.Metric) (float64, bool) {
+	switch mf.GetType() {
+	case dto.MetricType_GAUGE:
+		if g := m.GetGauge(); g != nil {
+			return g.GetValue(), true
+		}
+	case dto.MetricType_COUNTER:
+		if c := m.GetCounter(); c != nil {
+			return c.GetValue(), true
+		}
+	case dto.MetricType_UNTYPED:
+		if u := m.GetUntyped(); u != nil {
+			return u.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+// labelsForMetric builds the label set a sample is keyed by: the metric
+// name plus every label on the dto.Metric, with externalLabels filled in
+// for anything not already set by the target itself.
+func labelsForMetric(name string, m *dto.Metric, externalLabels labels.Labels) labels.Labels {
+	lset := make(labels.Labels, 0, len(m.GetLabel())+len(externalLabels)+1)
+	lset = append(lset, labels.Label{Name: labels.MetricName, Value: name})
+	for _, lp := range m.GetLabel() {
+		lset = append(lset, labels.Label{Name: lp.GetName(), Value: lp.GetValue()})
+	}
+	for _, l := range externalLabels {
+		if !lset.Has(l.Name) {
+			lset = append(lset, l)
+		}
+	}
+	lset.Sort()
+	return lset
+}
+
+// sampleToTimeSeries builds the Stackdriver TimeSeries for a single
+// (labels, timestamp, value) point. Multi-point batching across samples
+// that belong to the same series is left to the caller; Stackdriver
+// accepts one point per TimeSeries per request just as readily.
+func sampleToTimeSeries(lset labels.Labels, ts int64, v float64) *monitoring.TimeSeries {
+	t := time.Unix(0, ts*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+	return &monitoring.TimeSeries{
+		Metric: &monitoring.Metric{
+			Type:   metricsPrefix + "/" + lset.Get(labels.MetricName),
+			Labels: metricLabels(lset),
+		},
+		Points: []*monitoring.Point{
+			{
+				Interval: &monitoring.TimeInterval{EndTime: t},
+				Value:    &monitoring.TypedValue{DoubleValue: &v},
+			},
+		},
+	}
+}
+
+// metricLabels converts lset into the string map Stackdriver expects,
+// dropping __name__ since that's carried in the metric Type instead.
+func metricLabels(lset labels.Labels) map[string]string {
+	out := make(map[string]string, len(lset))
+	for _, l := range lset {
+		if l.Name == labels.MetricName {
+			continue
+		}
+		out[l.Name] = l.Value
+	}
+	return out
+}
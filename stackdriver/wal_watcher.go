@@ -0,0 +1,134 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"io"
+	"os"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+// replayWAL reads dir, calling onSeries for every recordSeries entry in
+// every segment and returning, in order, the decoded samples written after
+// the checkpointed position. It is the single place that understands the
+// on-disk record format, so the live writer (Append) and the restart-time
+// reader can never drift apart.
+func replayWAL(dir string, from walProgress, onSeries func(seriesRef, labels.Labels) error) ([]refSample, walProgress, error) {
+	first, last, err := wal.Segments(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, from, nil
+		}
+		return nil, from, err
+	}
+
+	var samples []refSample
+	pos := from
+	for segIdx := first; segIdx <= last; segIdx++ {
+		// Segments up to from.Segment are already fully acknowledged
+		// (or, at -1, there's nothing to skip): replaying their samples
+		// again would resend a whole segment's worth of delivered
+		// samples on every restart. Their series records are still
+		// read, since later samples refer to series logged only there.
+		acked := segIdx <= from.Segment
+		seg, err := wal.OpenReadSegment(wal.SegmentName(dir, segIdx))
+		if err != nil {
+			return nil, pos, err
+		}
+		r := wal.NewLiveReader(log.NewNopLogger(), nil, seg)
+
+		for r.Next() {
+			rec := r.Record()
+			if len(rec) == 0 {
+				continue
+			}
+			switch recordType(rec[0]) {
+			case recordSeries:
+				ref, lset, err := decodeSeries(rec[1:])
+				if err != nil {
+					seg.Close()
+					return nil, pos, err
+				}
+				if onSeries != nil {
+					if err := onSeries(ref, lset); err != nil {
+						seg.Close()
+						return nil, pos, err
+					}
+				}
+			case recordSamples:
+				if acked {
+					continue
+				}
+				decoded, err := decodeSamples(rec[1:])
+				if err != nil {
+					seg.Close()
+					return nil, pos, err
+				}
+				for i := range decoded {
+					decoded[i].seg = int64(segIdx)
+				}
+				samples = append(samples, decoded...)
+			}
+		}
+		if err := r.Err(); err != nil && err != io.EOF {
+			seg.Close()
+			return nil, pos, err
+		}
+		if !acked {
+			pos = walProgress{Segment: segIdx}
+		}
+		seg.Close()
+	}
+	return samples, pos, nil
+}
+
+// recoveryTailer replays whatever the WAL holds past the last checkpoint
+// into the live queue manager. It exists purely to survive a process
+// restart: once it has drained the backlog, Append feeds the shard queues
+// directly for the rest of the process lifetime, exactly as it would if
+// the WAL had never been involved.
+type recoveryTailer struct {
+	dir string
+	qm  *QueueManager
+}
+
+func newRecoveryTailer(qm *QueueManager) *recoveryTailer {
+	return &recoveryTailer{dir: qm.walDir, qm: qm}
+}
+
+// run replays everything written since the last checkpoint, enqueuing
+// samples through the normal (blocking) shard path so back-pressure is
+// applied identically to live Append traffic.
+func (rt *recoveryTailer) run() error {
+	prog, err := readProgress(rt.dir)
+	if err != nil {
+		return err
+	}
+
+	samples, _, err := replayWAL(rt.dir, prog, func(ref seriesRef, lset labels.Labels) error {
+		rt.qm.cacheSeries(ref, lset)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range samples {
+		rt.qm.enqueue(s)
+	}
+	return nil
+}